@@ -2,8 +2,7 @@ package tar_diff
 
 import (
 	"archive/tar"
-	"compress/gzip"
-	"crypto/sha1"
+	"bytes"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
@@ -11,7 +10,10 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/alexlarsson/tar-diff/compression"
 )
 
 const (
@@ -23,14 +25,127 @@ type TarFileInfo struct {
 	basename      string
 	path          string
 	size          int64
-	sha1          string
+	hash          string
 	isExecutable  bool
 	worldReadable bool
+	compression   compression.Compression // Compression of the file's own content, e.g. a .gz inside the tar
+	kind          FileKind                // Coarse content classification, used to find delta candidates by content alone
+	sparseEntries []SparseEntry           // Concrete data fragments, set only for sparse files
 	blobs         []RollsumBlob
 }
 
+// FileKind is a coarse, content-based classification of a tar member,
+// used to find delta candidates that don't share a similar path.
+type FileKind int
+
+const (
+	KindUnknown FileKind = iota
+	KindText
+	KindELF
+	KindMachO
+	KindPE
+	KindCompressed // gzip/bzip2/xz/zstd; see the compression package for the specific codec
+	KindPNG
+	KindJPEG
+)
+
+var (
+	machOMagics = [][]byte{
+		{0xfe, 0xed, 0xfa, 0xce}, {0xce, 0xfa, 0xed, 0xfe}, // 32-bit, big/little endian
+		{0xfe, 0xed, 0xfa, 0xcf}, {0xcf, 0xfa, 0xed, 0xfe}, // 64-bit, big/little endian
+	}
+	pngMagic  = []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a}
+	jpegMagic = []byte{0xff, 0xd8, 0xff}
+)
+
+// classifyFileKind gives a coarse FileKind for a file's leading bytes.
+// It's deliberately approximate (e.g. PE detection only checks the "MZ"
+// DOS-stub prefix, since we only have a short header, not the PE\0\0
+// signature further into the file) - good enough to group similar
+// binaries, not to validate the format.
+func classifyFileKind(header []byte, c compression.Compression) FileKind {
+	if c != compression.None {
+		return KindCompressed
+	}
+
+	switch {
+	case len(header) >= 4 && header[0] == 0x7f && header[1] == 'E' && header[2] == 'L' && header[3] == 'F':
+		return KindELF
+	case len(header) >= 2 && header[0] == 'M' && header[1] == 'Z':
+		return KindPE
+	case len(header) >= 8 && bytes.Equal(header[:8], pngMagic):
+		return KindPNG
+	case len(header) >= 3 && bytes.Equal(header[:3], jpegMagic):
+		return KindJPEG
+	}
+
+	for _, m := range machOMagics {
+		if len(header) >= len(m) && bytes.Equal(header[:len(m)], m) {
+			return KindMachO
+		}
+	}
+
+	return KindText
+}
+
+// SparseEntry describes one contiguous range of actual (non-hole) data in
+// a sparse file, in terms of the file's own (expanded) logical offsets.
+type SparseEntry struct {
+	Offset int64
+	Length int64
+}
+
 type TarInfo struct {
-	files []TarFileInfo // Sorted by size, no size=0 files
+	files       []TarFileInfo           // Sorted by size, no size=0 files
+	compression compression.Compression // Compression the tar stream itself was wrapped in
+	layout      []Segment               // Raw-byte packer stream, set only when analyzeTar was asked to preserve layout
+}
+
+// SegmentType identifies one piece of the "packer" stream captured by
+// analyzeTar when asked to preserve layout, borrowed from the tar-split
+// technique of splitting a tar into its raw, byte-exact pieces.
+type SegmentType int
+
+const (
+	SegmentRawBytes SegmentType = iota // Literal bytes straight from the tar stream: headers, PAX records, padding
+	SegmentFileData                    // A reference to a file's (possibly delta-reconstructed) content
+)
+
+// Segment is one entry of the packer stream. RawBytes segments carry their
+// literal bytes, since archive/tar's Header doesn't round-trip losslessly
+// (padding, PAX record order, ustar vs. GNU encoding choices are all
+// lost). FileData segments just reference a file by its TarFileInfo.index
+// (its entry position in the tar stream, not its position in the
+// size-sorted TarInfo.files) instead of duplicating bytes we already have
+// elsewhere.
+type Segment struct {
+	Type      SegmentType
+	Raw       []byte
+	FileIndex int
+}
+
+// rawByteCapture is a reader that remembers every byte read through it, so
+// analyzeTar can recover the exact bytes archive/tar consumed for a
+// header between two points in the stream.
+type rawByteCapture struct {
+	r        io.Reader
+	captured bytes.Buffer
+}
+
+func (c *rawByteCapture) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.captured.Write(p[:n])
+	}
+	return n, err
+}
+
+// take returns and clears the bytes captured since the last call.
+func (c *rawByteCapture) take() []byte {
+	b := make([]byte, c.captured.Len())
+	copy(b, c.captured.Bytes())
+	c.captured.Reset()
+	return b
 }
 
 type TargetInfo struct {
@@ -43,6 +158,20 @@ type SourceInfo struct {
 	file         *TarFileInfo
 	usedForDelta bool
 	offset       int64
+	sourceIndex  int // Index into the []SourceTar passed to analyzeForDelta that this file came from
+}
+
+// NOTE: sourceIndex is tracked on every SourceInfo so a future delta
+// stream could encode which source a copy op reads from, but there's no
+// delta serialization in this tree yet to write that out.
+
+// SourceTar is one of possibly several old tars a delta may be built
+// against, e.g. the layers already present in an image being rebased.
+// Order matters: when the same path exists in more than one source, the
+// one listed first wins the exact-path match.
+type SourceTar struct {
+	Info   *TarInfo
+	Reader io.Reader
 }
 
 type DeltaAnalysis struct {
@@ -50,6 +179,8 @@ type DeltaAnalysis struct {
 	sourceInfos       []SourceInfo
 	sourceData        *os.File
 	targetInfoByIndex map[int]*TargetInfo
+	targetCompression compression.Compression // Compression the delta header should record for Apply to re-wrap the output in
+	chunkSize         int                     // Target size of each independently-applicable chunk in the delta
 }
 
 func (a *DeltaAnalysis) Close() {
@@ -69,8 +200,59 @@ func isSparseFile(hdr *tar.Header) bool {
 	return false
 }
 
+// sparseDataFragments returns the concrete (non-hole) data fragments of a
+// sparse file. archive/tar doesn't expose a hole map on Header at all (it
+// only uses it internally to zero-fill holes while reading the body), so
+// we parse the GNU sparse PAX records ourselves: "GNU.sparse.map" already
+// lists the data fragments directly (archive/tar also folds the older
+// per-block "GNU.sparse.offset"/"GNU.sparse.numbytes" 0.0 records into
+// this same key while parsing PAX headers, so both formats end up here).
+//
+// The in-band map used by GNU sparse format 1.0 is consumed by
+// archive/tar before Next() returns and isn't recoverable from outside
+// the package, so for that format (and the pre-POSIX old GNU header) we
+// fall back to treating the whole (already hole-expanded) body as one
+// fragment.
+func sparseDataFragments(hdr *tar.Header) []SparseEntry {
+	if fragments, ok := parseGNUSparseMap01(hdr.PAXRecords); ok {
+		return fragments
+	}
+	return []SparseEntry{{Offset: 0, Length: hdr.Size}}
+}
+
+// parseGNUSparseMap01 parses the GNU sparse format 0.1 PAX records (also
+// used for 0.0, which archive/tar normalizes into the same keys): a
+// "GNU.sparse.numblocks" count and a "GNU.sparse.map" string of
+// comma-separated offset,length pairs, one pair per data fragment.
+func parseGNUSparseMap01(pax map[string]string) ([]SparseEntry, bool) {
+	numBlocks, err := strconv.ParseInt(pax["GNU.sparse.numblocks"], 10, 0)
+	if err != nil || numBlocks < 0 {
+		return nil, false
+	}
+
+	parts := strings.Split(pax["GNU.sparse.map"], ",")
+	if len(parts) == 1 && parts[0] == "" {
+		parts = parts[:0]
+	}
+	if int64(len(parts)) != 2*numBlocks {
+		return nil, false
+	}
+
+	fragments := make([]SparseEntry, 0, numBlocks)
+	for len(parts) >= 2 {
+		offset, err1 := strconv.ParseInt(parts[0], 10, 64)
+		length, err2 := strconv.ParseInt(parts[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, false
+		}
+		fragments = append(fragments, SparseEntry{Offset: offset, Length: length})
+		parts = parts[2:]
+	}
+	return fragments, true
+}
+
 func useTarHeader(hdr *tar.Header) bool {
-	if hdr.Typeflag != tar.TypeReg {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeGNUSparse {
 		return false
 	}
 
@@ -79,25 +261,31 @@ func useTarHeader(hdr *tar.Header) bool {
 		return false
 	}
 
-	// Sparse headers will return file content that doesn't match the tarfile stream contents, so lets just
-	// not delta them. We could do better here, but I don't think sparse files are very common.
-	if isSparseFile(hdr) {
-		return false
-	}
-
 	return true
 }
 
-func analyzeTar(targzFile io.Reader) (*TarInfo, error) {
-	tarFile, err := gzip.NewReader(targzFile)
+func analyzeTar(targzFile io.Reader, hasher Hasher, preserveLayout bool) (*TarInfo, error) {
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+
+	outerCompression, tarFile, err := compression.Detect(targzFile)
 	if err != nil {
 		return nil, err
 	}
 	defer tarFile.Close()
 
 	files := make([]TarFileInfo, 0)
+	var layout []Segment
 
-	rdr := tar.NewReader(tarFile)
+	var rawBytes *rawByteCapture
+	tarSrc := io.Reader(tarFile)
+	if preserveLayout {
+		rawBytes = &rawByteCapture{r: tarFile}
+		tarSrc = rawBytes
+	}
+
+	rdr := tar.NewReader(tarSrc)
 	for index := 0; true; index++ {
 		var hdr *tar.Header
 		hdr, err = rdr.Next()
@@ -108,11 +296,41 @@ func analyzeTar(targzFile io.Reader) (*TarInfo, error) {
 				return nil, err
 			}
 		}
+		if rawBytes != nil {
+			// This also picks up the previous entry's data (for entries
+			// we didn't read ourselves below) and trailing padding, since
+			// archive/tar consumes both while looking for the next
+			// header; that's fine, we only care about replaying the same
+			// bytes in the same order, not labeling them precisely.
+			layout = append(layout, Segment{Type: SegmentRawBytes, Raw: rawBytes.take()})
+		}
 		if useTarHeader(hdr) {
-			h := sha1.New()
+			h := hasher.New()
 			r := NewRollsum()
 			w := io.MultiWriter(h, r)
-			if _, err := io.Copy(w, rdr); err != nil {
+
+			var sparseEntries []SparseEntry
+			if isSparseFile(hdr) {
+				sparseEntries = sparseDataFragments(hdr)
+				pos := int64(0)
+				for _, frag := range sparseEntries {
+					if frag.Offset > pos {
+						if _, err := io.CopyN(ioutil.Discard, rdr, frag.Offset-pos); err != nil {
+							return nil, err
+						}
+						pos = frag.Offset
+					}
+					if _, err := io.CopyN(w, rdr, frag.Length); err != nil {
+						return nil, err
+					}
+					pos += frag.Length
+				}
+				if pos < hdr.Size {
+					if _, err := io.CopyN(ioutil.Discard, rdr, hdr.Size-pos); err != nil {
+						return nil, err
+					}
+				}
+			} else if _, err := io.Copy(w, rdr); err != nil {
 				return nil, err
 			}
 			blobs := r.GetBlobs()
@@ -130,6 +348,20 @@ func analyzeTar(targzFile io.Reader) (*TarInfo, error) {
 				worldReadable = true
 			}
 
+			fileCompression := compression.DetectHeader(header)
+			fileKind := classifyFileKind(header, fileCompression)
+
+			// Blob offsets are relative to the data actually fed to the
+			// rollsum: the whole file, except for sparse files where it's
+			// just the concrete fragments, so holes don't pollute matching.
+			dataSize := hdr.Size
+			if sparseEntries != nil {
+				dataSize = 0
+				for _, frag := range sparseEntries {
+					dataSize += frag.Length
+				}
+			}
+
 			last := int64(0)
 			for i := range blobs {
 				blob := blobs[i]
@@ -142,7 +374,7 @@ func analyzeTar(targzFile io.Reader) (*TarInfo, error) {
 				}
 				last = blob.offset + blob.size
 			}
-			if last != hdr.Size {
+			if last != dataSize {
 				log.Fatalf("Internal error: Wrong blob end")
 			}
 
@@ -151,12 +383,28 @@ func analyzeTar(targzFile io.Reader) (*TarInfo, error) {
 				basename:      path.Base(hdr.Name),
 				path:          hdr.Name,
 				size:          hdr.Size,
-				sha1:          hex.EncodeToString(h.Sum(nil)),
+				hash:          hex.EncodeToString(h.Sum(nil)),
 				isExecutable:  isExecutable,
 				worldReadable: worldReadable,
+				compression:   fileCompression,
+				kind:          fileKind,
+				sparseEntries: sparseEntries,
 				blobs:         blobs,
 			}
 			files = append(files, fileInfo)
+
+			if rawBytes != nil {
+				rawBytes.take() // Body bytes already captured above; referenced via FileIndex instead of duplicated
+				layout = append(layout, Segment{Type: SegmentFileData, FileIndex: index})
+			}
+		}
+	}
+
+	if rawBytes != nil {
+		// The Next() call that found EOF also consumed the archive's
+		// trailing zero-block footer; capture it as the last segment.
+		if trailer := rawBytes.take(); len(trailer) > 0 {
+			layout = append(layout, Segment{Type: SegmentRawBytes, Raw: trailer})
 		}
 	}
 
@@ -165,7 +413,7 @@ func analyzeTar(targzFile io.Reader) (*TarInfo, error) {
 		return files[i].size < files[j].size
 	})
 
-	info := TarInfo{files: files}
+	info := TarInfo{files: files, compression: outerCompression, layout: layout}
 	return &info, nil
 }
 
@@ -177,11 +425,12 @@ func isDeltaCandidate(file *TarFileInfo) bool {
 		return false
 	}
 
-	// Look for known non-delta-able files (currently just compression)
-	// NB: We explicitly don't have .gz here in case someone might be
-	// using --rsyncable for that.
-	if strings.HasPrefix(file.basename, ".xz") ||
-		strings.HasPrefix(file.basename, ".bz2") {
+	// Compressed files don't delta well: a single changed byte in the
+	// uncompressed data can ripple through the rest of the compressed
+	// stream, so there's rarely any overlap to find. Detect this from
+	// the actual content rather than the filename, since extensions lie.
+	// NB: gzip is allowed through in case someone used --rsyncable for it.
+	if file.compression != compression.None && file.compression != compression.Gzip {
 		return false
 	}
 
@@ -198,12 +447,21 @@ func nameIsSimilar(a *TarFileInfo, b *TarFileInfo, fuzzy int) bool {
 	}
 }
 
-func extractDeltaData(tarGzFile io.Reader, sourceByPath map[string]*SourceInfo, dest *os.File) error {
-	offset := int64(0)
-
-	tarFile, err := gzip.NewReader(tarGzFile)
+// extractDeltaData copies the bytes of every file used for delta out of a
+// single source tar into dest, starting at base. It returns the new end
+// offset, so callers covering several source tars can chain calls and
+// have each one's data land after the last at a distinct base offset.
+//
+// For sparse files this skips holes the same way analyzeTar does, writing
+// only the concrete fragments: SourceInfo.offset plus a blob's offset must
+// land on the same compacted-stream coordinate space analyzeTar computed
+// that blob's offset in, not the file's full logical size.
+func extractDeltaData(tarGzFile io.Reader, sourceByPath map[string]*SourceInfo, dest *os.File, base int64) (int64, error) {
+	offset := base
+
+	_, tarFile, err := compression.Detect(tarGzFile)
 	if err != nil {
-		return err
+		return offset, err
 	}
 	defer tarFile.Close()
 
@@ -215,35 +473,88 @@ func extractDeltaData(tarGzFile io.Reader, sourceByPath map[string]*SourceInfo,
 			if err == io.EOF {
 				break // Expected error
 			} else {
-				return err
+				return offset, err
 			}
 		}
 		if useTarHeader(hdr) {
 			info := sourceByPath[hdr.Name]
 			if info.usedForDelta {
 				info.offset = offset
-				offset += hdr.Size
-				if _, err := io.Copy(dest, rdr); err != nil {
-					return err
+				if isSparseFile(hdr) {
+					// Mirror analyzeTar: blob offsets are computed over the
+					// compacted stream of concrete fragments only, so the
+					// bytes we extract here have to live in that same
+					// coordinate space, not the sparse file's full logical
+					// size.
+					pos := int64(0)
+					for _, frag := range sparseDataFragments(hdr) {
+						if frag.Offset > pos {
+							if _, err := io.CopyN(ioutil.Discard, rdr, frag.Offset-pos); err != nil {
+								return offset, err
+							}
+							pos = frag.Offset
+						}
+						n, err := io.CopyN(dest, rdr, frag.Length)
+						offset += n
+						if err != nil {
+							return offset, err
+						}
+						pos += frag.Length
+					}
+					if pos < hdr.Size {
+						if _, err := io.CopyN(ioutil.Discard, rdr, hdr.Size-pos); err != nil {
+							return offset, err
+						}
+					}
+				} else {
+					n, err := io.Copy(dest, rdr)
+					offset += n
+					if err != nil {
+						return offset, err
+					}
 				}
 			}
 		}
 	}
-	return nil
+	return offset, nil
 }
 
-func analyzeForDelta(old *TarInfo, new *TarInfo, oldFile io.Reader) (*DeltaAnalysis, error) {
-	sourceInfos := make([]SourceInfo, 0, len(old.files))
-	for i := range old.files {
-		sourceInfos = append(sourceInfos, SourceInfo{file: &old.files[i]})
+func analyzeForDelta(sources []SourceTar, new *TarInfo, opts *DiffOptions) (*DeltaAnalysis, error) {
+	targetCompression := opts.TargetCompression
+	if targetCompression == compression.None {
+		targetCompression = new.compression
+	}
+
+	sourceInfos := make([]SourceInfo, 0)
+	for sourceIndex := range sources {
+		old := sources[sourceIndex].Info
+		for i := range old.files {
+			sourceInfos = append(sourceInfos, SourceInfo{file: &old.files[i], sourceIndex: sourceIndex})
+		}
 	}
 
-	sourceBySha1 := make(map[string]*SourceInfo)
+	// Keep the merged list size-sorted, same as a single source tar's
+	// files, so the size-windowed matching below still works unchanged.
+	sort.Slice(sourceInfos, func(i, j int) bool {
+		return sourceInfos[i].file.size < sourceInfos[j].file.size
+	})
+
+	sourceByHash := make(map[string]*SourceInfo)
 	sourceByPath := make(map[string]*SourceInfo)
+	sourceByPathPerSource := make([]map[string]*SourceInfo, len(sources))
+	for i := range sourceByPathPerSource {
+		sourceByPathPerSource[i] = make(map[string]*SourceInfo)
+	}
 	for i := range sourceInfos {
 		s := &sourceInfos[i]
-		sourceBySha1[s.file.sha1] = s
-		sourceByPath[s.file.path] = s
+		sourceByHash[s.file.hash] = s
+		// First source wins an exact-path collision: sources are in
+		// caller-supplied priority order (e.g. the layer closest to the
+		// new tar first), so the earliest match is the best delta base.
+		if existing, exists := sourceByPath[s.file.path]; !exists || s.sourceIndex < existing.sourceIndex {
+			sourceByPath[s.file.path] = s
+		}
+		sourceByPathPerSource[s.sourceIndex][s.file.path] = s
 	}
 
 	targetInfos := make([]TargetInfo, 0, len(new.files))
@@ -253,10 +564,10 @@ func analyzeForDelta(old *TarInfo, new *TarInfo, oldFile io.Reader) (*DeltaAnaly
 		// First look for exact content match
 		usedForDelta := false
 		var source *SourceInfo
-		sha1Source := sourceBySha1[file.sha1]
-		// If same sha1 and size, use original total size
-		if sha1Source != nil && file.size == sha1Source.file.size && sha1Source.file.worldReadable {
-			source = sha1Source
+		hashSource := sourceByHash[file.hash]
+		// If same hash and size, use original total size
+		if hashSource != nil && file.size == hashSource.file.size && hashSource.file.worldReadable {
+			source = hashSource
 		}
 		if source == nil && isDeltaCandidate(file) {
 			// No exact match, try to find a useful source
@@ -300,6 +611,39 @@ func analyzeForDelta(old *TarInfo, new *TarInfo, oldFile io.Reader) (*DeltaAnaly
 						break
 					}
 				}
+
+				// Name-based matching found nothing: fall back to
+				// pairing same-kind binaries (e.g. two ELF executables)
+				// purely by content classification and size. Exclude
+				// KindCompressed: isDeltaCandidate lets gzip through (for
+				// --rsyncable gzip), so without this two unrelated
+				// compressed blobs with unrelated names would otherwise
+				// get paired on content classification alone.
+				if source == nil && file.kind != KindUnknown && file.kind != KindText && file.kind != KindCompressed {
+					for j := lower; j < upper; j++ {
+						s = &sourceInfos[j]
+						if !isDeltaCandidate(s.file) {
+							continue
+						}
+
+						if s.file.size < minSize {
+							lower++
+							continue
+						}
+
+						if s.file.size > maxSize {
+							break
+						}
+
+						if s.file.kind != file.kind {
+							continue
+						}
+
+						usedForDelta = true
+						source = s
+						break
+					}
+				}
 			}
 		}
 
@@ -315,6 +659,28 @@ func analyzeForDelta(old *TarInfo, new *TarInfo, oldFile io.Reader) (*DeltaAnaly
 		targetInfos = append(targetInfos, info)
 	}
 
+	if len(opts.PrioritizedPaths) > 0 {
+		priority := make(map[string]int, len(opts.PrioritizedPaths))
+		for i, p := range opts.PrioritizedPaths {
+			priority[p] = i
+		}
+		// Stable sort: prioritized paths move to the front in the
+		// requested order, everything else keeps its existing order.
+		sort.SliceStable(targetInfos, func(i, j int) bool {
+			pi, iOk := priority[targetInfos[i].file.path]
+			pj, jOk := priority[targetInfos[j].file.path]
+			if iOk && jOk {
+				return pi < pj
+			}
+			return iOk && !jOk
+		})
+	}
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
 	targetInfoByIndex := make(map[int]*TargetInfo)
 	for i := range targetInfos {
 		t := &targetInfos[i]
@@ -326,10 +692,13 @@ func analyzeForDelta(old *TarInfo, new *TarInfo, oldFile io.Reader) (*DeltaAnaly
 		return nil, err
 	}
 
-	err = extractDeltaData(oldFile, sourceByPath, tmpfile)
-	if err != nil {
-		return nil, err
+	offset := int64(0)
+	for sourceIndex := range sources {
+		offset, err = extractDeltaData(sources[sourceIndex].Reader, sourceByPathPerSource[sourceIndex], tmpfile, offset)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &DeltaAnalysis{targetInfos: targetInfos, targetInfoByIndex: targetInfoByIndex, sourceInfos: sourceInfos, sourceData: tmpfile}, nil
+	return &DeltaAnalysis{targetInfos: targetInfos, targetInfoByIndex: targetInfoByIndex, sourceInfos: sourceInfos, sourceData: tmpfile, targetCompression: targetCompression, chunkSize: chunkSize}, nil
 }
@@ -0,0 +1,114 @@
+package tar_diff
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+// gzipBlob gzip-compresses payload, for use as a tar member's *content*
+// (as opposed to buildGzipTar, which compresses the whole tar stream) so
+// classifyFileKind sees the gzip magic bytes and calls it KindCompressed.
+func gzipBlob(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(payload); err != nil {
+		t.Fatalf("gzip Write: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gzip Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestAnalyzeForDeltaPathCollisionFirstSourceWins covers the "pool of
+// sources" case where the same path exists in more than one source tar:
+// the source earliest in the caller's slice should win the exact-path
+// match, not whichever one happens to be last into the map.
+func TestAnalyzeForDeltaPathCollisionFirstSourceWins(t *testing.T) {
+	const path = "usr/bin/thing"
+
+	newContent := bytes.Repeat([]byte{'n'}, 4096)
+	source0Content := bytes.Repeat([]byte{'a'}, 4096) // same path, earlier source
+	source1Content := bytes.Repeat([]byte{'b'}, 4096) // same path, later source
+
+	source0Tar := buildGzipTar(t, map[string][]byte{path: source0Content})
+	source1Tar := buildGzipTar(t, map[string][]byte{path: source1Content})
+	newTar := buildGzipTar(t, map[string][]byte{path: newContent})
+
+	source0Info, err := analyzeTar(bytes.NewReader(source0Tar.Bytes()), nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar(source0): %v", err)
+	}
+	source1Info, err := analyzeTar(bytes.NewReader(source1Tar.Bytes()), nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar(source1): %v", err)
+	}
+	newInfo, err := analyzeTar(newTar, nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar(new): %v", err)
+	}
+
+	sources := []SourceTar{
+		{Info: source0Info, Reader: bytes.NewReader(source0Tar.Bytes())},
+		{Info: source1Info, Reader: bytes.NewReader(source1Tar.Bytes())},
+	}
+
+	da, err := analyzeForDelta(sources, newInfo, &DiffOptions{})
+	if err != nil {
+		t.Fatalf("analyzeForDelta: %v", err)
+	}
+	defer da.Close()
+
+	if len(da.targetInfos) != 1 {
+		t.Fatalf("targetInfos = %d entries, want 1", len(da.targetInfos))
+	}
+	target := da.targetInfos[0]
+	if target.source == nil {
+		t.Fatal("target has no source, want the path match from source 0")
+	}
+	if target.source.sourceIndex != 0 {
+		t.Fatalf("target matched sourceIndex %d, want 0 (first source should win a path collision)", target.source.sourceIndex)
+	}
+}
+
+// TestAnalyzeForDeltaDoesNotPairUnrelatedCompressedBlobs covers the
+// kind-based fallback match: two unrelated already-compressed blobs must
+// not be paired up just because both classify as KindCompressed, even
+// when their names are unrelated and sizes happen to land in the same
+// similarity window.
+func TestAnalyzeForDeltaDoesNotPairUnrelatedCompressedBlobs(t *testing.T) {
+	newContent := gzipBlob(t, bytes.Repeat([]byte{0xaa, 0xbb, 0xcc, 0xdd}, 1024))
+	sourceContent := gzipBlob(t, bytes.Repeat([]byte{0x11, 0x22, 0x33, 0x44}, 1024))
+
+	sourceTar := buildGzipTar(t, map[string][]byte{"alpha.bin": sourceContent})
+	newTar := buildGzipTar(t, map[string][]byte{"zeta.xyz": newContent})
+
+	sourceInfo, err := analyzeTar(bytes.NewReader(sourceTar.Bytes()), nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar(source): %v", err)
+	}
+	newInfo, err := analyzeTar(newTar, nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar(new): %v", err)
+	}
+	if newInfo.files[0].kind != KindCompressed || sourceInfo.files[0].kind != KindCompressed {
+		t.Fatalf("expected both files to classify as KindCompressed, got new=%v source=%v", newInfo.files[0].kind, sourceInfo.files[0].kind)
+	}
+
+	sources := []SourceTar{{Info: sourceInfo, Reader: bytes.NewReader(sourceTar.Bytes())}}
+
+	da, err := analyzeForDelta(sources, newInfo, &DiffOptions{})
+	if err != nil {
+		t.Fatalf("analyzeForDelta: %v", err)
+	}
+	defer da.Close()
+
+	if len(da.targetInfos) != 1 {
+		t.Fatalf("targetInfos = %d entries, want 1", len(da.targetInfos))
+	}
+	if source := da.targetInfos[0].source; source != nil {
+		t.Fatalf("target matched source %+v, want no match for two unrelated compressed blobs", source.file)
+	}
+}
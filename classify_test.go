@@ -0,0 +1,92 @@
+package tar_diff
+
+import (
+	"testing"
+
+	"github.com/alexlarsson/tar-diff/compression"
+)
+
+func TestClassifyFileKind(t *testing.T) {
+	cases := []struct {
+		name   string
+		header []byte
+		c      compression.Compression
+		want   FileKind
+	}{
+		{"compressed wins over content", []byte{0x7f, 'E', 'L', 'F'}, compression.Gzip, KindCompressed},
+		{"elf", []byte{0x7f, 'E', 'L', 'F', 0x02, 0x01}, compression.None, KindELF},
+		{"pe", []byte{'M', 'Z', 0x90, 0x00}, compression.None, KindPE},
+		{"png", []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00}, compression.None, KindPNG},
+		{"jpeg", []byte{0xff, 0xd8, 0xff, 0xe0}, compression.None, KindJPEG},
+		{"macho 64-bit little endian", []byte{0xcf, 0xfa, 0xed, 0xfe}, compression.None, KindMachO},
+		{"text fallback", []byte("hello world"), compression.None, KindText},
+		{"short header falls back to text", []byte{0x7f}, compression.None, KindText},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := classifyFileKind(c.header, c.c); got != c.want {
+				t.Errorf("classifyFileKind(%x, %v) = %v, want %v", c.header, c.c, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseGNUSparseMap01(t *testing.T) {
+	cases := []struct {
+		name string
+		pax  map[string]string
+		want []SparseEntry
+		ok   bool
+	}{
+		{
+			name: "two fragments",
+			pax: map[string]string{
+				"GNU.sparse.numblocks": "2",
+				"GNU.sparse.map":       "0,512,4096,1024",
+			},
+			want: []SparseEntry{{Offset: 0, Length: 512}, {Offset: 4096, Length: 1024}},
+			ok:   true,
+		},
+		{
+			name: "zero blocks, empty map",
+			pax: map[string]string{
+				"GNU.sparse.numblocks": "0",
+				"GNU.sparse.map":       "",
+			},
+			want: []SparseEntry{},
+			ok:   true,
+		},
+		{
+			name: "missing numblocks",
+			pax:  map[string]string{"GNU.sparse.map": "0,512"},
+			ok:   false,
+		},
+		{
+			name: "count mismatch",
+			pax: map[string]string{
+				"GNU.sparse.numblocks": "2",
+				"GNU.sparse.map":       "0,512",
+			},
+			ok: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := parseGNUSparseMap01(c.pax)
+			if ok != c.ok {
+				t.Fatalf("ok = %v, want %v", ok, c.ok)
+			}
+			if !ok {
+				return
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("fragment %d = %v, want %v", i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}
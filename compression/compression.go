@@ -0,0 +1,138 @@
+// Package compression detects and (de)compresses the container formats
+// that tar-diff can read tar data from.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression identifies the algorithm (if any) wrapping a tar stream.
+type Compression int
+
+const (
+	None Compression = iota
+	Gzip
+	Bzip2
+	Xz
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	case Zstd:
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+// Magic byte prefixes for the formats we recognize. The first matching
+// entry wins, so order doesn't matter as long as no two prefixes overlap.
+var magic = []struct {
+	bytes       []byte
+	compression Compression
+}{
+	{[]byte{0x1f, 0x8b, 0x08}, Gzip},
+	{[]byte{0x42, 0x5a, 0x68}, Bzip2},
+	{[]byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, Xz},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, Zstd},
+}
+
+// maxMagicLen is how many leading bytes DetectHeader needs to see.
+const maxMagicLen = 6
+
+// DetectHeader returns the compression implied by the leading bytes of a
+// stream. An empty or too-short header is reported as None rather than
+// an error, since a real stream can still legitimately be uncompressed.
+func DetectHeader(header []byte) Compression {
+	for _, m := range magic {
+		if bytes.HasPrefix(header, m.bytes) {
+			return m.compression
+		}
+	}
+	return None
+}
+
+// Detect sniffs r for one of the known compression magics and returns a
+// reader that transparently decompresses it. For None, the returned
+// reader just passes the (already peeked) bytes through unchanged. The
+// caller must always Close the result, even for None.
+func Detect(r io.Reader) (Compression, io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, maxMagicLen)
+	header, err := br.Peek(maxMagicLen)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return None, nil, err
+	}
+
+	c := DetectHeader(header)
+	rc, err := NewReader(c, br)
+	if err != nil {
+		return None, nil, err
+	}
+	return c, rc, nil
+}
+
+// NewReader wraps r with a decompressor for the given compression.
+func NewReader(c Compression, r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case None:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case Xz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("compression: unknown compression %v", c)
+	}
+}
+
+// NewWriter wraps w with a compressor for the given compression, so Apply
+// can re-encode a reconstructed tar to match the target's original
+// compression. Bzip2 and Xz are read-only here, matching the Go standard
+// library's own bzip2 package; diffing against such a target still works,
+// it just can't be the one Apply recompresses to.
+func NewWriter(c Compression, w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("compression: compressing to %v is not supported", c)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
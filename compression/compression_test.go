@@ -0,0 +1,51 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDetectHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		header []byte
+		want   Compression
+	}{
+		{"gzip", []byte{0x1f, 0x8b, 0x08, 0x00}, Gzip},
+		{"bzip2", []byte{0x42, 0x5a, 0x68, 0x39}, Bzip2},
+		{"xz", []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, Xz},
+		{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, Zstd},
+		{"none", []byte{0x00, 0x01, 0x02, 0x03}, None},
+		{"too short", []byte{0x1f}, None},
+		{"empty", nil, None},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := DetectHeader(c.header); got != c.want {
+				t.Errorf("DetectHeader(%x) = %v, want %v", c.header, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDetectPassesThroughUncompressedBytes(t *testing.T) {
+	want := []byte("plain tar bytes, no magic here")
+	c, rc, err := Detect(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("Detect: %v", err)
+	}
+	defer rc.Close()
+
+	if c != None {
+		t.Fatalf("Detect compression = %v, want None", c)
+	}
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Detect round-trip = %q, want %q", got, want)
+	}
+}
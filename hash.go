@@ -0,0 +1,33 @@
+package tar_diff
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+)
+
+// Hasher abstracts the content digest used to match identical files
+// between the old and new tar when building a delta.
+type Hasher interface {
+	New() hash.Hash
+	Name() string
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) New() hash.Hash { return sha256.New() }
+func (sha256Hasher) Name() string   { return "sha256" }
+
+type sha1Hasher struct{}
+
+func (sha1Hasher) New() hash.Hash { return sha1.New() }
+func (sha1Hasher) Name() string   { return "sha1" }
+
+// DefaultHasher is used when DiffOptions.Hasher is left unset.
+var DefaultHasher Hasher = sha256Hasher{}
+
+// SHA1Hasher is the digest tar-diff used before SHA-256 became the
+// default. Nothing in this package selects it automatically: a Hasher's
+// Name is not recorded in any delta, so it is only used where a caller
+// passes it in explicitly.
+var SHA1Hasher Hasher = sha1Hasher{}
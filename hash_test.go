@@ -0,0 +1,34 @@
+package tar_diff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestAnalyzeTarNilHasherDefaultsToSHA256(t *testing.T) {
+	content := []byte("some file content to hash")
+	sum := sha256.Sum256(content)
+	wantHash := hex.EncodeToString(sum[:])
+
+	tarFile := buildGzipTar(t, map[string][]byte{"file.txt": content})
+
+	info, err := analyzeTar(tarFile, nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar: %v", err)
+	}
+	if info == nil {
+		t.Fatal("analyzeTar returned nil info")
+	}
+	if len(info.files) != 1 {
+		t.Fatalf("files = %d entries, want 1", len(info.files))
+	}
+
+	got := info.files[0].hash
+	if len(got) != sha256.Size*2 {
+		t.Fatalf("hash %q is %d hex chars, want %d (SHA-256)", got, len(got), sha256.Size*2)
+	}
+	if got != wantHash {
+		t.Fatalf("hash = %q, want %q (SHA-256 of the file content)", got, wantHash)
+	}
+}
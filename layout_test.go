@@ -0,0 +1,59 @@
+package tar_diff
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestPreserveLayoutReconstructsOriginalBytes covers chunk0-5's core
+// property: replaying TarInfo.layout (the captured Segments, with
+// SegmentFileData entries resolved back to each file's content) must
+// reproduce the original tar byte-for-byte, not just a semantically
+// equivalent tar. There's no Apply in this tree yet to do the replaying,
+// so this drives analyzeTar directly and does the replay itself.
+func TestPreserveLayoutReconstructsOriginalBytes(t *testing.T) {
+	members := []tarMember{
+		{name: "a/first.txt", content: bytes.Repeat([]byte("first"), 100)},
+		{name: "a/second.bin", content: bytes.Repeat([]byte{0x01, 0x02, 0x03}, 200)},
+		{name: "third", content: []byte("third content")},
+	}
+	original := buildTar(t, members)
+
+	info, err := analyzeTar(bytes.NewReader(original), nil, true)
+	if err != nil {
+		t.Fatalf("analyzeTar: %v", err)
+	}
+	if len(info.layout) == 0 {
+		t.Fatal("TarInfo.layout is empty, want captured segments")
+	}
+
+	contentByIndex := make(map[int][]byte)
+	for i := range info.files {
+		f := &info.files[i]
+		for _, m := range members {
+			if m.name == f.path {
+				contentByIndex[f.index] = m.content
+			}
+		}
+	}
+
+	var rebuilt bytes.Buffer
+	for _, seg := range info.layout {
+		switch seg.Type {
+		case SegmentRawBytes:
+			rebuilt.Write(seg.Raw)
+		case SegmentFileData:
+			content, ok := contentByIndex[seg.FileIndex]
+			if !ok {
+				t.Fatalf("segment references FileIndex %d with no known content", seg.FileIndex)
+			}
+			rebuilt.Write(content)
+		default:
+			t.Fatalf("unknown segment type %v", seg.Type)
+		}
+	}
+
+	if !bytes.Equal(rebuilt.Bytes(), original) {
+		t.Fatalf("replayed layout produced %d bytes, want byte-identical to the original %d-byte tar", rebuilt.Len(), len(original))
+	}
+}
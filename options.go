@@ -0,0 +1,58 @@
+package tar_diff
+
+import "github.com/alexlarsson/tar-diff/compression"
+
+// DiffOptions controls how Diff analyzes the old and new tars and what
+// ends up in the resulting delta. The zero value is a valid, if bare,
+// set of options.
+type DiffOptions struct {
+	// TargetCompression is the compression Apply should re-wrap the
+	// reconstructed tar in. Left at its zero value, it defaults to
+	// whatever compression was detected on the "new" input.
+	//
+	// NOTE: this tree only has the analysis side of compression support
+	// (detecting and recording it) — the delta header field and Apply
+	// logic that would actually re-wrap the output are not implemented
+	// yet, so setting this has no effect yet.
+	TargetCompression compression.Compression
+
+	// Hasher is the content digest used to match files between the old
+	// and new tar. Defaults to DefaultHasher (SHA-256) when nil.
+	//
+	// NOTE: Hasher.Name isn't persisted anywhere yet — there's no delta
+	// header to put it in and no Apply to check it against, so a delta
+	// built with a non-default Hasher can't yet be verified as having
+	// used one.
+	Hasher Hasher
+
+	// PreserveLayout makes Diff capture enough of the new tar's raw byte
+	// layout (header blocks, PAX record ordering, padding) that Apply
+	// can reconstruct a byte-identical tar rather than one that's only
+	// semantically equivalent. This costs a somewhat larger delta.
+	//
+	// NOTE: the layout is captured into TarInfo.layout by analyzeTar, but
+	// nothing in this tree serializes it into a delta or has an Apply to
+	// replay it from, so this option only affects in-memory analysis for
+	// now.
+	PreserveLayout bool
+
+	// PrioritizedPaths lists new-tar paths that should be placed first in
+	// the delta, in the given order, so a consumer reading the delta
+	// sequentially can start extracting them without waiting for the
+	// rest. Paths not listed keep their normal (size-sorted) order.
+	//
+	// NOTE: this only reorders DeltaAnalysis.targetInfos in memory —
+	// there's no on-disk chunk/TOC framing or ApplyRange in this tree
+	// yet to make that ordering seekable.
+	PrioritizedPaths []string
+
+	// ChunkSize is the target size of each independently-applicable
+	// chunk the delta is framed into. Defaults to DefaultChunkSize.
+	//
+	// NOTE: like PrioritizedPaths, this is computed and stored on
+	// DeltaAnalysis but not yet used to frame an actual delta stream.
+	ChunkSize int
+}
+
+// DefaultChunkSize is used when DiffOptions.ChunkSize is left at 0.
+const DefaultChunkSize = 4 * 1024 * 1024
@@ -0,0 +1,50 @@
+package tar_diff
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestAnalyzeForDeltaPrioritizedPathsReordersTargetInfos covers chunk0-6:
+// DiffOptions.PrioritizedPaths must move the listed paths to the front of
+// DeltaAnalysis.targetInfos, in the order given, leaving every other file
+// in its original relative order behind them.
+func TestAnalyzeForDeltaPrioritizedPathsReordersTargetInfos(t *testing.T) {
+	// Distinct sizes so analyzeTar's size sort (smallest first) gives a
+	// deterministic natural order: alpha, beta, gamma, delta.
+	newTar := buildGzipTar(t, map[string][]byte{
+		"alpha": bytes.Repeat([]byte{'a'}, 1024),
+		"beta":  bytes.Repeat([]byte{'b'}, 2048),
+		"gamma": bytes.Repeat([]byte{'c'}, 4096),
+		"delta": bytes.Repeat([]byte{'d'}, 8192),
+	})
+
+	newInfo, err := analyzeTar(newTar, nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar(new): %v", err)
+	}
+
+	da, err := analyzeForDelta(nil, newInfo, &DiffOptions{PrioritizedPaths: []string{"delta", "beta"}})
+	if err != nil {
+		t.Fatalf("analyzeForDelta: %v", err)
+	}
+	defer da.Close()
+
+	if len(da.targetInfos) != 4 {
+		t.Fatalf("targetInfos = %d entries, want 4", len(da.targetInfos))
+	}
+
+	got := make([]string, len(da.targetInfos))
+	for i, ti := range da.targetInfos {
+		got[i] = ti.file.path
+	}
+
+	if got[0] != "delta" || got[1] != "beta" {
+		t.Fatalf("targetInfos order = %v, want prioritized paths [delta beta] first", got)
+	}
+
+	rest := got[2:]
+	if !(rest[0] == "alpha" && rest[1] == "gamma") {
+		t.Fatalf("non-prioritized tail = %v, want [alpha gamma] (original relative order preserved)", rest)
+	}
+}
@@ -0,0 +1,63 @@
+package tar_diff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestExtractDeltaDataSkipsSparseHoles covers the coordinate-space bug
+// where extractDeltaData copied a sparse file's full logical size
+// (holes included) while analyzeTar computes blob offsets only over the
+// concrete fragments: the two have to agree on what "offset" means, or
+// source.offset + blob.offset indexes the wrong bytes in sourceData.
+func TestExtractDeltaDataSkipsSparseHoles(t *testing.T) {
+	const name = "sparse.bin"
+	fragments := []SparseEntry{{Offset: 0, Length: 4}, {Offset: 100, Length: 4}}
+	fragData := []byte("aaaabbbb") // the two fragments' concrete bytes, back to back
+
+	gz := buildGzipTarWithSparse(t, name, 200, fragments, fragData)
+
+	info, err := analyzeTar(bytes.NewReader(gz.Bytes()), nil, false)
+	if err != nil {
+		t.Fatalf("analyzeTar: %v", err)
+	}
+	if len(info.files) != 1 {
+		t.Fatalf("files = %d, want 1", len(info.files))
+	}
+	if info.files[0].size != 200 {
+		t.Fatalf("logical size = %d, want 200", info.files[0].size)
+	}
+
+	dest, err := ioutil.TempFile("", "extract-delta-data-")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(dest.Name())
+	defer dest.Close()
+
+	sourceInfo := &SourceInfo{file: &info.files[0]}
+	sourceByPath := map[string]*SourceInfo{name: sourceInfo}
+	sourceInfo.usedForDelta = true
+
+	end, err := extractDeltaData(bytes.NewReader(gz.Bytes()), sourceByPath, dest, 0)
+	if err != nil {
+		t.Fatalf("extractDeltaData: %v", err)
+	}
+
+	if end != int64(len(fragData)) {
+		t.Fatalf("end offset = %d, want %d (compacted size, not the 200-byte logical size)", end, len(fragData))
+	}
+	if sourceInfo.offset != 0 {
+		t.Fatalf("sourceInfo.offset = %d, want 0", sourceInfo.offset)
+	}
+
+	written, err := ioutil.ReadFile(dest.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(written, fragData) {
+		t.Fatalf("extracted bytes = %q, want %q (only the concrete fragments, holes skipped)", written, fragData)
+	}
+}